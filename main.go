@@ -5,39 +5,125 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
 	"cloud.google.com/go/compute/metadata"
 )
 
+// fallbackPollInterval is how often a job with a webhook configured still
+// polls on its own, as a safety net in case hooks are lost or misconfigured.
+const fallbackPollInterval = 15 * time.Minute
+
+// defaultArchiveCacheMB is used when ARCHIVE_CACHE_MB isn't set.
+const defaultArchiveCacheMB = 64
+
+// staleAfter is how long a job can go without a successful sync before
+// it's reported as stale by /status, /statusz.json, and /metrics.
+const staleAfter = 15 * time.Minute
+
+// stateDir, if set from the STATE_DIR env var, is where each job's clone
+// and state.json are kept so a rescheduled container can pick up where it
+// left off instead of recloning from scratch.
+var stateDir string
+
+// archives caches rendered tarballs so repeat requests for the same
+// (job, resolved SHA) don't shell out to git archive every time.
+var archives *archiveCache
+
 var jobs []*job
 
 type job struct {
+	// pushOK and pushFail count completed sync cycles by outcome, for the
+	// reposync_push_total metric. Accessed with atomic, not mu, since
+	// /metrics shouldn't contend with the mirror loop's status updates.
+	// They must stay the first fields: sync/atomic requires 64-bit
+	// operands to be 8-byte aligned, which is only guaranteed for the
+	// first word of an allocated struct on 32-bit platforms.
+	pushOK   uint64
+	pushFail uint64
+
 	ID   string
 	From string
 	To   string
 
 	HTTPCookie string
 
+	// RefSpec controls which refs are mirrored, as "src:dst" pairs in git's
+	// own refspec syntax. Defaults to every branch and every tag.
+	RefSpec []string
+
+	// DeleteStale prunes refs on "to" that no longer exist on "from",
+	// instead of only ever adding and updating refs.
+	DeleteStale bool
+
+	// SSHPrivateKey (PEM) and SSHKnownHosts authenticate git@ and ssh://
+	// remotes, as an alternative to HTTPCookie for HTTPS ones.
+	SSHPrivateKey string
+	SSHKnownHosts string
+
+	// WebhookSecret, if set, switches this job from tight polling to
+	// webhook-driven syncing: a push notification to /hook/{ID} wakes the
+	// mirror loop immediately instead of waiting on the poll interval.
+	WebhookSecret string
+
+	// wake is signaled by the webhook handler to run a sync cycle right
+	// away. It is buffered so bursts of hooks coalesce into one wakeup.
+	wake chan struct{}
+
+	// sshAuthMethod is built once from SSHPrivateKey/SSHKnownHosts at
+	// mirror startup and reused for every ssh:// or git@ operation.
+	sshAuthMethod *ssh.PublicKeys
+
 	// Status reporting
 	mu            sync.Mutex
 	lastOK        time.Time // last healthy status
 	statusTime    time.Time // time status was set
 	statusOK      bool      // normal state?
 	statusMessage string    // status indicator, suitable for public use
+	ready         bool      // has the initial clone completed?
+	headSHA       string    // resolved SHA of "from"'s HEAD as of the last sync
+	syncDuration  time.Duration
+}
+
+// jobState is the subset of a job's state that's checkpointed to
+// ${STATE_DIR}/<ID>/state.json so it survives a reschedule without a full
+// reclone.
+type jobState struct {
+	Hash   string    `json:"hash"`
+	LastOK time.Time `json:"lastOK"`
 }
 
 func main() {
@@ -49,6 +135,7 @@ func main() {
 		// repo spec (json)
 		spec = os.Getenv("REPOS")
 	)
+	stateDir = os.Getenv("STATE_DIR")
 	if spec != "" {
 		spec = reconcile(spec)
 		if err := json.Unmarshal([]byte(spec), &jobs); err != nil {
@@ -69,13 +156,31 @@ func main() {
 		}
 		j.From = reconcile(j.From)
 		j.To = reconcile(j.To)
+		if (isSSHURL(j.From) || isSSHURL(j.To)) && j.SSHPrivateKey == "" {
+			log.Fatalf("Job %s uses a git@ or ssh:// remote but has no SSHPrivateKey configured", j.ID)
+		}
 		j.statusOK = true
+		j.wake = make(chan struct{}, 1)
 
 		go j.mirror()
 	}
 
+	archiveCacheMB := defaultArchiveCacheMB
+	if v := os.Getenv("ARCHIVE_CACHE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_CACHE_MB %q: %v", v, err)
+		}
+		archiveCacheMB = n
+	}
+	archives = newArchiveCache(archiveCacheMB)
+
 	http.Handle("/", http.RedirectHandler("https://github.com/broady/reposync", http.StatusTemporaryRedirect))
 	http.HandleFunc("/status", statusz)
+	http.HandleFunc("/statusz.json", statuszJSON)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/hook/", hookHandler)
+	http.HandleFunc("/archive/", archiveHandler)
 
 	port := "8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -98,113 +203,678 @@ func reconcile(s string) string {
 }
 
 func (j *job) dir() string {
+	if stateDir != "" {
+		return filepath.Join(stateDir, j.ID, "repo")
+	}
 	return "repo-" + j.ID
 }
 
-func (j *job) cookiefile() string {
-	return "cookies-" + j.ID
+// statePath returns where this job's checkpointed state.json lives, or ""
+// if STATE_DIR isn't configured and nothing should be persisted.
+func (j *job) statePath() string {
+	if stateDir == "" {
+		return ""
+	}
+	return filepath.Join(stateDir, j.ID, "state.json")
 }
 
-func (j *job) mirror() {
-	j.ok("Cloning")
+// loadState reads this job's checkpointed state, if STATE_DIR is
+// configured and a checkpoint exists. A missing file is not an error: it
+// just means this job hasn't synced since STATE_DIR was introduced, or
+// ever.
+func (j *job) loadState() (jobState, error) {
+	path := j.statePath()
+	if path == "" {
+		return jobState{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return jobState{}, nil
+	}
+	if err != nil {
+		return jobState{}, err
+	}
+	var st jobState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return jobState{}, err
+	}
+	return st, nil
+}
 
-	for {
-		cmd := exec.Command("git", "clone", j.From, j.dir())
-		out, err := cmd.CombinedOutput()
-		if err == nil {
-			j.ok("Cloned", out)
-			break
-		}
-		j.statusErr("Cloning", err, out)
-		os.RemoveAll(j.dir())
-		time.Sleep(10 * time.Second)
-		continue
+// saveState checkpoints this job's state to statePath, if configured, via
+// write-temp-then-rename so a crash mid-write never leaves a truncated
+// state.json behind.
+func (j *job) saveState(st jobState) error {
+	path := j.statePath()
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	if j.HTTPCookie != "" {
-		if err := ioutil.WriteFile(j.cookiefile(), []byte(j.HTTPCookie), 0400); err != nil {
-			j.statusErr("Writing HTTP cookie file", err)
+func (j *job) knownHostsFile() string {
+	return "known-" + j.ID
+}
+
+// isSSHURL reports whether url is an scp-like or ssh:// git remote.
+func isSSHURL(url string) bool {
+	return strings.HasPrefix(url, "git@") || strings.HasPrefix(url, "ssh://")
+}
+
+// setupSSH builds the auth method used for any ssh:// or git@ remote from
+// this job's key material, writing SSHKnownHosts to disk since
+// knownhosts.New needs a path. It is a no-op if no SSHPrivateKey is
+// configured. The private key itself is kept in memory only - go-git
+// authenticates from the ssh.PublicKeys it builds, not from a key file.
+func (j *job) setupSSH() error {
+	if j.SSHPrivateKey == "" {
+		return nil
+	}
+
+	auth, err := ssh.NewPublicKeys("git", []byte(j.SSHPrivateKey), "")
+	if err != nil {
+		return fmt.Errorf("parse ssh key: %w", err)
+	}
+
+	if j.SSHKnownHosts != "" {
+		if err := ioutil.WriteFile(j.knownHostsFile(), []byte(j.SSHKnownHosts), 0400); err != nil {
+			return fmt.Errorf("write known_hosts: %w", err)
 		}
-		cmd := exec.Command("git", "config", "http.cookiefile", j.cookiefile())
-		cmd.Dir = j.dir()
-		out, err := cmd.CombinedOutput()
+		cb, err := knownhosts.New(j.knownHostsFile())
 		if err != nil {
-			j.statusErr("Set cookie file", err, out)
-		} else {
-			j.ok("Set http.cookiefile")
+			return fmt.Errorf("parse known_hosts: %w", err)
 		}
+		auth.HostKeyCallback = cb
 	}
 
-	for {
-		j.ok("Setting remote")
-		cmd := exec.Command("git", "remote", "add", "to", j.To)
-		cmd.Dir = j.dir()
-		out, err := cmd.CombinedOutput()
-		if err == nil {
-			j.ok("Added remote", out)
-			break
+	j.sshAuthMethod = auth
+	return nil
+}
+
+// transportAuth picks the auth method appropriate for url: the job's SSH
+// key for git@/ssh:// remotes, or its HTTP cookie otherwise.
+func (j *job) transportAuth(url string) transport.AuthMethod {
+	if isSSHURL(url) {
+		return j.sshAuthMethod
+	}
+	return j.httpAuth()
+}
+
+// defaultRefSpec is used when a job doesn't configure its own RefSpec: every
+// branch and every tag.
+var defaultRefSpec = []string{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// ensureRemote makes sure repo has a remote named name pointing at url,
+// creating it if absent and recreating it if it points somewhere else -
+// which matters for a clone reused from a checkpoint whose From/To may
+// have been reconfigured since it was first cloned.
+func ensureRemote(repo *git.Repository, name, url string) error {
+	remote, err := repo.Remote(name)
+	switch {
+	case err == git.ErrRemoteNotFound:
+		// fall through to create it below
+	case err != nil:
+		return err
+	case len(remote.Config().URLs) == 1 && remote.Config().URLs[0] == url:
+		return nil
+	default:
+		if err := repo.DeleteRemote(name); err != nil {
+			return err
+		}
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: name, URLs: []string{url}})
+	return err
+}
+
+// refSpecs returns the job's configured RefSpec, or defaultRefSpec if it
+// didn't set one.
+func (j *job) refSpecs() []config.RefSpec {
+	raw := j.RefSpec
+	if len(raw) == 0 {
+		raw = defaultRefSpec
+	}
+	specs := make([]config.RefSpec, len(raw))
+	for i, s := range raw {
+		specs[i] = config.RefSpec(s)
+	}
+	return specs
+}
+
+func (j *job) mirror() {
+	if err := j.setupSSH(); err != nil {
+		j.statusErr("SSH setup", err)
+		return
+	}
+
+	st, err := j.loadState()
+	if err != nil {
+		j.logf("Could not load checkpointed state, starting fresh: %v", err)
+		st = jobState{}
+	}
+
+	var repo *git.Repository
+	if r, err := git.PlainOpen(j.dir()); err == nil {
+		repo = r
+		j.logf("Reusing existing clone from checkpointed state")
+	} else {
+		j.ok("Cloning")
+		for {
+			r, err := git.PlainClone(j.dir(), true, &git.CloneOptions{
+				URL:  j.From,
+				Auth: j.transportAuth(j.From),
+			})
+			if err == nil {
+				repo = r
+				j.ok("Cloned")
+				break
+			}
+			j.statusErr("Cloning", err)
+			os.RemoveAll(j.dir())
+			time.Sleep(10 * time.Second)
 		}
-		j.statusErr("Adding remote", err, out)
-		time.Sleep(time.Second)
+		// A fresh clone invalidates any hash checkpointed against the old
+		// one; force the first loop iteration to push.
+		st.Hash = ""
 	}
 
+	j.mu.Lock()
+	j.ready = true
+	j.mu.Unlock()
+
+	// A reused clone's remotes were configured whenever it was originally
+	// cloned; make sure they still match From/To in case the job's config
+	// changed since (e.g. a new mirror host) while its checkpoint didn't.
+	if err := ensureRemote(repo, "origin", j.From); err != nil {
+		j.statusErr("Configuring origin remote", err)
+		return
+	}
+	if err := ensureRemote(repo, "to", j.To); err != nil {
+		j.statusErr("Configuring to remote", err)
+		return
+	}
+	j.ok("Added remote")
+
+	if !st.LastOK.IsZero() {
+		// Restore the checkpointed lastOK after all of the startup-phase
+		// ok() calls above (Cloned/Reused/Added remote), which would
+		// otherwise stomp it with time.Now(): a rescheduled job shouldn't
+		// be reported as freshly-synced, or reposync_stale reset to 0,
+		// until it actually completes a sync.
+		j.mu.Lock()
+		j.lastOK = st.LastOK
+		j.mu.Unlock()
+	}
+
+	// limit is the floor between sync attempts. It also acts as the
+	// coalescing window for webhook-driven jobs: a burst of hooks that
+	// arrive faster than this rate collapses into a single sync.
 	limit := rate.NewLimiter(rate.Every(time.Minute), 1)
 
-	var oldSHA, oldTags []byte
+	refSpecs := j.refSpecs()
+	oldHash := st.Hash
+
+	// Prime an immediate first sync. Without this, a webhook-configured
+	// job would sit on waitForTrigger's wake/fallbackPollInterval select
+	// after a cold clone, leaving "to" empty or stale for up to 15
+	// minutes while lastOK (set by the startup ok() calls above) already
+	// reports the job healthy.
+	j.wakeUp()
 
 	for {
 		ctx := context.Background()
-		limit.Wait(ctx)
-
-		j.logf("Pulling")
-		cmd := exec.CommandContext(ctx, "git", "pull")
-		cmd.Dir = j.dir()
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			j.statusErr("Pull", err, out)
-			continue
-		}
-		j.logf("Pulled: %s", out)
+		j.waitForTrigger(ctx, limit)
+		start := time.Now()
 
-		sha, err := ioutil.ReadFile(j.dir() + "/.git/refs/heads/master")
-		if err != nil {
-			j.statusErr("parse HEAD", err)
+		j.logf("Fetching")
+		err := repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "origin",
+			Auth:       j.transportAuth(j.From),
+			RefSpecs:   refSpecs,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			j.statusErr("Fetch", err)
+			atomic.AddUint64(&j.pushFail, 1)
 			continue
 		}
+		j.logf("Fetched")
 
-		cmd = exec.CommandContext(ctx, "git", "tag", "-l")
-		cmd.Dir = j.dir()
-		tags, err := cmd.CombinedOutput()
+		hash, err := refHash(repo, refSpecs)
 		if err != nil {
-			j.statusErr("git tag -l", tags)
+			j.statusErr("Hash refs", err)
+			atomic.AddUint64(&j.pushFail, 1)
 			continue
 		}
 
-		if !bytes.Equal(sha, oldSHA) {
+		if hash != oldHash {
 			j.logf("Pushing")
-			cmd = exec.CommandContext(ctx, "git", "push", "--all", "to")
-			cmd.Dir = j.dir()
-			out, err = cmd.CombinedOutput()
-			if err != nil {
-				j.statusErr("Push", err, out)
+			err = repo.PushContext(ctx, &git.PushOptions{
+				RemoteName: "to",
+				Auth:       j.transportAuth(j.To),
+				RefSpecs:   refSpecs,
+				Prune:      j.DeleteStale,
+			})
+			if err != nil && err != git.NoErrAlreadyUpToDate {
+				j.statusErr("Push", err)
+				atomic.AddUint64(&j.pushFail, 1)
 				continue
 			}
 		}
 
-		if !bytes.Equal(tags, oldTags) {
-			j.logf("Pushing tags")
-			cmd = exec.CommandContext(ctx, "git", "push", "--tags", "to")
-			cmd.Dir = j.dir()
-			out, err = cmd.CombinedOutput()
-			if err != nil {
-				j.statusErr("Push tags", err, out)
-				continue
-			}
+		j.mu.Lock()
+		j.syncDuration = time.Since(start)
+		if head, err := repo.Head(); err == nil {
+			j.headSHA = head.Hash().String()
 		}
+		j.mu.Unlock()
 
 		j.ok("Synced")
-		oldSHA = sha
-		oldTags = tags
+		atomic.AddUint64(&j.pushOK, 1)
+		oldHash = hash
+
+		if err := j.saveState(jobState{Hash: hash, LastOK: time.Now()}); err != nil {
+			j.logf("Could not checkpoint state: %v", err)
+		}
+	}
+}
+
+// refHash computes a stable digest over every ref matching specs' source
+// patterns, so any change to any selected branch or tag - not just
+// master's tip - is detected as work to push.
+func refHash(repo *git.Repository, specs []config.RefSpec) (string, error) {
+	prefixes := make([]string, len(specs))
+	for i, s := range specs {
+		prefixes[i] = strings.TrimSuffix(s.Src(), "*")
+	}
+
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				lines = append(lines, name+" "+ref.Hash().String())
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// httpAuth builds the go-git auth method for this job's HTTP remotes, or
+// nil if no cookie is configured.
+func (j *job) httpAuth() transport.AuthMethod {
+	if j.HTTPCookie == "" {
+		return nil
+	}
+	return &cookieAuth{cookie: j.HTTPCookie}
+}
+
+// cookieAuth attaches an arbitrary Cookie header to every request, the
+// go-git equivalent of git's http.cookiefile.
+type cookieAuth struct {
+	cookie string
+}
+
+func (c *cookieAuth) Name() string   { return "cookie" }
+func (c *cookieAuth) String() string { return "cookie - <redacted>" }
+
+func (c *cookieAuth) SetAuth(r *http.Request) {
+	r.Header.Set("Cookie", c.cookie)
+}
+
+// waitForTrigger blocks until it is time to run the next sync cycle. Jobs
+// without a webhook secret keep the original tight-polling behavior, gated
+// only by limit. Jobs with a webhook secret instead wait for a wakeUp (or a
+// slow fallback poll), then still pass through limit so hooks can't drive
+// the sync rate above the floor.
+func (j *job) waitForTrigger(ctx context.Context, limit *rate.Limiter) {
+	if j.WebhookSecret == "" {
+		limit.Wait(ctx)
+		return
+	}
+
+	select {
+	case <-j.wake:
+	case <-time.After(fallbackPollInterval):
+	}
+	limit.Wait(ctx)
+}
+
+// wakeUp signals the job's mirror loop to sync as soon as the rate limiter
+// allows. It never blocks: a pending wakeup is enough to cover any number of
+// hooks that arrive before it's consumed.
+func (j *job) wakeUp() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// findJob returns the job with the given ID, or nil if there isn't one.
+func findJob(id string) *job {
+	for _, j := range jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// hookHandler accepts GitHub, GitLab, and Gitea push webhooks at
+// /hook/{ID} and wakes the matching job's mirror loop so it syncs
+// immediately instead of waiting for its next poll.
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/hook/")
+	j := findJob(id)
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if j.WebhookSecret == "" {
+		http.Error(w, "no webhook configured for this job", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !validSignature(r, body, j.WebhookSecret) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		Ref string `json:"ref"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Ref == "" {
+		http.Error(w, "payload has no ref", http.StatusBadRequest)
+		return
+	}
+
+	j.logf("Webhook push for %s", payload.Ref)
+	j.wakeUp()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature checks a webhook request against secret, supporting
+// GitHub/Gitea's HMAC-SHA256 X-Hub-Signature-256 header and GitLab's plain
+// shared-token X-Gitlab-Token header.
+func validSignature(r *http.Request, body []byte, secret string) bool {
+	if tok := r.Header.Get("X-Gitlab-Token"); tok != "" {
+		return hmac.Equal([]byte(tok), []byte(secret))
+	}
+
+	sig := r.Header.Get("X-Hub-Signature-256")
+	if sig == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// isReady reports whether the job has a working directory to serve
+// archives out of (ready) and its last sync attempt succeeded (statusOK),
+// as chunk0-2 specifies: a job that cloned but whose syncs are failing
+// shouldn't serve archives either.
+func (j *job) isReady() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.ready && j.statusOK
+}
+
+// resolveRef resolves a branch, tag, or SHA to a commit SHA within the
+// job's clone, entirely in-process via go-git - no git binary required.
+func (j *job) resolveRef(ref string) (string, error) {
+	repo, err := git.PlainOpen(j.dir())
+	if err != nil {
+		return "", fmt.Errorf("open repo: %w", err)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", fmt.Errorf("resolve ref %q: %w", ref, err)
+	}
+	return hash.String(), nil
+}
+
+// archiveTarGz produces a gzipped tar of the given commit by walking its
+// tree with go-git, the in-process equivalent of `git archive
+// --format=tar.gz`.
+func (j *job) archiveTarGz(sha string) ([]byte, error) {
+	repo, err := git.PlainOpen(j.dir())
+	if err != nil {
+		return nil, fmt.Errorf("open repo: %w", err)
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(sha))
+	if err != nil {
+		return nil, fmt.Errorf("load commit %s: %w", sha, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("load tree for %s: %w", sha, err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("walk tree: %w", err)
+		}
+		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
+			continue
+		}
+		if err := writeTarEntry(tw, repo, name, entry); err != nil {
+			return nil, fmt.Errorf("write %s: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTarEntry writes a single blob tree entry as one file (or symlink)
+// in tw.
+func writeTarEntry(tw *tar.Writer, repo *git.Repository, name string, entry object.TreeEntry) error {
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return fmt.Errorf("load blob: %w", err)
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	mode, err := entry.Mode.ToOSFileMode()
+	if err != nil {
+		return fmt.Errorf("file mode: %w", err)
+	}
+
+	hdr := &tar.Header{
+		Name: name,
+		Mode: int64(mode.Perm()),
+		Size: blob.Size,
+	}
+	if entry.Mode == filemode.Symlink {
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+		hdr.Size = 0
+		return tw.WriteHeader(hdr)
+	}
+
+	hdr.Typeflag = tar.TypeReg
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// archiveHandler serves /archive/{ID}/{ref}.tar.gz, a gzipped tar snapshot
+// of the named ref from the job's local mirror.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/archive/")
+	id, rest := splitOnce(path, "/")
+	if rest == "" || !strings.HasSuffix(rest, ".tar.gz") {
+		http.NotFound(w, r)
+		return
+	}
+	ref := strings.TrimSuffix(rest, ".tar.gz")
+
+	j := findJob(id)
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !j.isReady() {
+		http.Error(w, "repo has not been mirrored yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	sha, err := j.resolveRef(ref)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := archiveKey{id: j.ID, sha: sha}
+	data, ok := archives.get(key)
+	if !ok {
+		data, err = j.archiveTarGz(sha)
+		if err != nil {
+			j.logf("Archive of %s failed: %v", sha, err)
+			http.Error(w, "could not produce archive", http.StatusInternalServerError)
+			return
+		}
+		archives.put(key, data)
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.tar.gz"`, j.ID, ref))
+	w.Write(data)
+}
+
+// splitOnce splits s on the first occurrence of sep, returning "" for the
+// remainder if sep isn't found.
+func splitOnce(s, sep string) (before, after string) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+len(sep):]
+}
+
+// archiveKey identifies a cached tarball by job and resolved commit SHA, so
+// the same ref moving to a new SHA doesn't serve stale content.
+type archiveKey struct {
+	id  string
+	sha string
+}
+
+// archiveCache is an in-memory, size-bounded LRU cache of rendered
+// tarballs.
+type archiveCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	ll       *list.List
+	items    map[archiveKey]*list.Element
+}
+
+type archiveEntry struct {
+	key  archiveKey
+	data []byte
+}
+
+func newArchiveCache(maxMB int) *archiveCache {
+	return &archiveCache{
+		maxBytes: int64(maxMB) * 1 << 20,
+		ll:       list.New(),
+		items:    make(map[archiveKey]*list.Element),
+	}
+}
+
+func (c *archiveCache) get(key archiveKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*archiveEntry).data, true
+}
+
+func (c *archiveCache) put(key archiveKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.curBytes -= int64(len(e.Value.(*archiveEntry).data))
+		c.ll.MoveToFront(e)
+		e.Value.(*archiveEntry).data = data
+		c.curBytes += int64(len(data))
+	} else {
+		e := c.ll.PushFront(&archiveEntry{key: key, data: data})
+		c.items[key] = e
+		c.curBytes += int64(len(data))
+	}
+
+	for c.curBytes > c.maxBytes {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*archiveEntry)
+		c.curBytes -= int64(len(entry.data))
+		c.ll.Remove(back)
+		delete(c.items, entry.key)
 	}
 }
 
@@ -213,7 +883,7 @@ func statusz(w http.ResponseWriter, r *http.Request) {
 
 	for _, j := range jobs {
 		j.mu.Lock()
-		if time.Since(j.lastOK) > 15*time.Minute {
+		if time.Since(j.lastOK) > staleAfter {
 			w.WriteHeader(500)
 			// Stale. Something went wrong.
 			fmt.Fprintf(w, "Repo %q possibly not fresh\n", j.ID)
@@ -232,6 +902,125 @@ func statusz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// jobStatusJSON is one entry of the /statusz.json document.
+type jobStatusJSON struct {
+	ID         string    `json:"id"`
+	OK         bool      `json:"ok"`
+	LastOK     time.Time `json:"lastOK"`
+	StatusTime time.Time `json:"statusTime"`
+	Message    string    `json:"message"`
+	FromHost   string    `json:"fromHost"`
+	ToHost     string    `json:"toHost"`
+	HeadSHA    string    `json:"headSHA"`
+	LagSeconds float64   `json:"lagSeconds"`
+}
+
+// statuszJSON serves a machine-readable equivalent of /status, suitable
+// for dashboards and alerting that don't want to scrape plain text.
+func statuszJSON(w http.ResponseWriter, r *http.Request) {
+	doc := struct {
+		Jobs []jobStatusJSON `json:"jobs"`
+	}{}
+
+	for _, j := range jobs {
+		j.mu.Lock()
+		doc.Jobs = append(doc.Jobs, jobStatusJSON{
+			ID:         j.ID,
+			OK:         j.statusOK,
+			LastOK:     j.lastOK,
+			StatusTime: j.statusTime,
+			Message:    j.statusMessage,
+			FromHost:   hostOf(j.From),
+			ToHost:     hostOf(j.To),
+			HeadSHA:    j.headSHA,
+			LagSeconds: time.Since(j.lastOK).Seconds(),
+		})
+		j.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// hostOf returns the host portion of a git remote URL, for status
+// reporting that shouldn't leak full URLs (which may carry tokens or
+// cookies). It understands both normal URLs and the scp-like
+// user@host:path form.
+func hostOf(remote string) string {
+	if isSSHURL(remote) && !strings.HasPrefix(remote, "ssh://") {
+		if _, hostAndPath, ok := strings.Cut(remote, "@"); ok {
+			host, _, _ := strings.Cut(hostAndPath, ":")
+			return host
+		}
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return remote
+	}
+	return u.Host
+}
+
+// jobMetrics is a single locked snapshot of the fields metricsHandler
+// reports, taken once per job rather than once per metric family.
+type jobMetrics struct {
+	id           string
+	lastOK       time.Time
+	syncDuration time.Duration
+	stale        bool
+	pushOK       uint64
+	pushFail     uint64
+}
+
+// metricsHandler exposes per-job sync state in Prometheus text exposition
+// format, so reposync can be scraped and alerted on like any other
+// service instead of requiring a /status text scrape.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	snapshots := make([]jobMetrics, len(jobs))
+	for i, j := range jobs {
+		j.mu.Lock()
+		snapshots[i] = jobMetrics{
+			id:           j.ID,
+			lastOK:       j.lastOK,
+			syncDuration: j.syncDuration,
+			stale:        time.Since(j.lastOK) > staleAfter,
+			pushOK:       atomic.LoadUint64(&j.pushOK),
+			pushFail:     atomic.LoadUint64(&j.pushFail),
+		}
+		j.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP reposync_last_ok_timestamp Unix timestamp of the last successful sync.")
+	fmt.Fprintln(w, "# TYPE reposync_last_ok_timestamp gauge")
+	for _, m := range snapshots {
+		fmt.Fprintf(w, "reposync_last_ok_timestamp{id=%q} %d\n", m.id, m.lastOK.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP reposync_sync_duration_seconds Duration of the most recent sync cycle.")
+	fmt.Fprintln(w, "# TYPE reposync_sync_duration_seconds gauge")
+	for _, m := range snapshots {
+		fmt.Fprintf(w, "reposync_sync_duration_seconds{id=%q} %f\n", m.id, m.syncDuration.Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP reposync_push_total Completed sync cycles by outcome.")
+	fmt.Fprintln(w, "# TYPE reposync_push_total counter")
+	for _, m := range snapshots {
+		fmt.Fprintf(w, "reposync_push_total{id=%q,result=\"ok\"} %d\n", m.id, m.pushOK)
+		fmt.Fprintf(w, "reposync_push_total{id=%q,result=\"fail\"} %d\n", m.id, m.pushFail)
+	}
+
+	fmt.Fprintln(w, "# HELP reposync_stale Whether a job hasn't had a successful sync within staleAfter.")
+	fmt.Fprintln(w, "# TYPE reposync_stale gauge")
+	for _, m := range snapshots {
+		stale := 0
+		if m.stale {
+			stale = 1
+		}
+		fmt.Fprintf(w, "reposync_stale{id=%q} %d\n", m.id, stale)
+	}
+}
+
 func (j *job) logf(msg string, v ...interface{}) {
 	out := fmt.Sprintf("["+j.ID+"] "+msg, v...)
 
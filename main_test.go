@@ -0,0 +1,258 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+func TestValidSignature(t *testing.T) {
+	const secret = "s3cr3t"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	validHubSig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		secret  string
+		want    bool
+	}{
+		{
+			name:    "valid github-style hmac",
+			headers: map[string]string{"X-Hub-Signature-256": validHubSig},
+			secret:  secret,
+			want:    true,
+		},
+		{
+			name:    "tampered body invalidates hmac",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(make([]byte, sha256.Size))},
+			secret:  secret,
+			want:    false,
+		},
+		{
+			name:    "missing signature header",
+			headers: map[string]string{},
+			secret:  secret,
+			want:    false,
+		},
+		{
+			name:    "empty signature header",
+			headers: map[string]string{"X-Hub-Signature-256": ""},
+			secret:  secret,
+			want:    false,
+		},
+		{
+			name:    "wrong secret",
+			headers: map[string]string{"X-Hub-Signature-256": validHubSig},
+			secret:  "different-secret",
+			want:    false,
+		},
+		{
+			name:    "valid gitlab token",
+			headers: map[string]string{"X-Gitlab-Token": secret},
+			secret:  secret,
+			want:    true,
+		},
+		{
+			name:    "wrong gitlab token",
+			headers: map[string]string{"X-Gitlab-Token": "nope"},
+			secret:  secret,
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/hook/default", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := validSignature(r, body, tt.secret); got != tt.want {
+				t.Errorf("validSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// initTestRepo creates an in-memory repo with a single commit on master and
+// returns it along with that commit's hash.
+func initTestRepo(t *testing.T) (*git.Repository, plumbing.Hash) {
+	t.Helper()
+
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatalf("git.Init: %v", err)
+	}
+
+	f, err := fs.Create("README")
+	if err != nil {
+		t.Fatalf("create README: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write README: %v", err)
+	}
+	f.Close()
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree: %v", err)
+	}
+	if _, err := wt.Add("README"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	hash, err := wt.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+	})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	return repo, hash
+}
+
+func TestRefHash(t *testing.T) {
+	repo, commit := initTestRepo(t)
+	specs := []config.RefSpec{
+		config.RefSpec("+refs/heads/*:refs/heads/*"),
+		config.RefSpec("+refs/tags/*:refs/tags/*"),
+	}
+
+	before, err := refHash(repo, specs)
+	if err != nil {
+		t.Fatalf("refHash: %v", err)
+	}
+
+	// A tag-only change - no new commit on master - must still change the
+	// hash, since that's the bug this function exists to fix.
+	tagRef := plumbing.NewHashReference(plumbing.ReferenceName("refs/tags/v1"), commit)
+	if err := repo.Storer.SetReference(tagRef); err != nil {
+		t.Fatalf("SetReference: %v", err)
+	}
+
+	after, err := refHash(repo, specs)
+	if err != nil {
+		t.Fatalf("refHash: %v", err)
+	}
+
+	if before == after {
+		t.Fatalf("refHash did not change after adding a tag: got %q both times", before)
+	}
+
+	again, err := refHash(repo, specs)
+	if err != nil {
+		t.Fatalf("refHash: %v", err)
+	}
+	if again != after {
+		t.Errorf("refHash is not stable across calls: %q != %q", again, after)
+	}
+}
+
+func TestArchiveCacheLRU(t *testing.T) {
+	c := &archiveCache{
+		maxBytes: 10,
+		ll:       list.New(),
+		items:    make(map[archiveKey]*list.Element),
+	}
+
+	a := archiveKey{id: "job", sha: "aaa"}
+	b := archiveKey{id: "job", sha: "bbb"}
+	cc := archiveKey{id: "job", sha: "ccc"}
+
+	c.put(a, make([]byte, 4))
+	c.put(b, make([]byte, 4))
+
+	// Touch a so it's most-recently-used; adding cc should then evict b,
+	// the least-recently-used entry, to stay under maxBytes.
+	if _, ok := c.get(a); !ok {
+		t.Fatalf("expected %v to be cached", a)
+	}
+	c.put(cc, make([]byte, 4))
+
+	if _, ok := c.get(a); !ok {
+		t.Errorf("%v was evicted, want it to survive (recently used)", a)
+	}
+	if _, ok := c.get(b); ok {
+		t.Errorf("%v was not evicted, want least-recently-used entry gone", b)
+	}
+	if _, ok := c.get(cc); !ok {
+		t.Errorf("%v was evicted, want it to survive (just inserted)", cc)
+	}
+}
+
+func TestLoadSaveStateRoundTrip(t *testing.T) {
+	old := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = old }()
+
+	j := &job{ID: "test"}
+	want := jobState{Hash: "deadbeef", LastOK: time.Unix(1234, 0).UTC()}
+
+	if err := j.saveState(want); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+
+	got, err := j.loadState()
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if got.Hash != want.Hash || !got.LastOK.Equal(want.LastOK) {
+		t.Errorf("loadState() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadStateMissing(t *testing.T) {
+	old := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = old }()
+
+	j := &job{ID: "never-synced"}
+	got, err := j.loadState()
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if got != (jobState{}) {
+		t.Errorf("loadState() on missing checkpoint = %+v, want zero value", got)
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		want   string
+	}{
+		{name: "scp-like form", remote: "git@github.com:codyoss/reposync.git", want: "github.com"},
+		{name: "https url", remote: "https://github.com/codyoss/reposync.git", want: "github.com"},
+		{name: "ssh url with port", remote: "ssh://git@example.com:2222/repo.git", want: "example.com:2222"},
+		{name: "unparsable string", remote: "not a url", want: "not a url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostOf(tt.remote); got != tt.want {
+				t.Errorf("hostOf(%q) = %q, want %q", tt.remote, got, tt.want)
+			}
+		})
+	}
+}